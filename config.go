@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config describes a full deployment: one or more APT repositories served
+// from a single process, each mounted under its own URL prefix.
+type config struct {
+	Repos []repoConfig `yaml:"repos"`
+}
+
+// repoConfig describes a single logical APT repository: where its backend
+// object store lives, which GitHub releases it should redirect to, its
+// mount point on the mux, and which filenames it's willing to serve.
+type repoConfig struct {
+	Prefix          string        `yaml:"prefix"`
+	DistsHost       string        `yaml:"distsHost"`
+	ReleasesURLs    []string      `yaml:"releasesURLs"`
+	AllowedNames    []string      `yaml:"allowedNames"`
+	RefreshInterval time.Duration `yaml:"refreshInterval"`
+	CacheTime       time.Duration `yaml:"cacheTime"`
+}
+
+// loadConfig reads and parses a multi-repo config file in YAML format.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg config
+	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(cfg.Repos) == 0 {
+		return nil, fmt.Errorf("parsing %s: no repos defined", path)
+	}
+	seenPrefixes := make(map[string]bool, len(cfg.Repos))
+	for i, repo := range cfg.Repos {
+		if repo.Prefix == "" {
+			return nil, fmt.Errorf("repo %d: prefix is required", i)
+		}
+		// http.ServeMux only subtree-matches a pattern ending in "/"; a
+		// bare "/dists/stable" would match just that exact path and 404
+		// on everything beneath it, which is never what's intended here.
+		if !strings.HasSuffix(repo.Prefix, "/") {
+			return nil, fmt.Errorf("repo %d (%s): prefix must end in \"/\"", i, repo.Prefix)
+		}
+		if seenPrefixes[repo.Prefix] {
+			return nil, fmt.Errorf("repo %d (%s): prefix is already used by another repo", i, repo.Prefix)
+		}
+		seenPrefixes[repo.Prefix] = true
+		if repo.DistsHost == "" {
+			return nil, fmt.Errorf("repo %d (%s): distsHost is required", i, repo.Prefix)
+		}
+		if repo.RefreshInterval == 0 {
+			cfg.Repos[i].RefreshInterval = 5 * time.Minute
+		}
+		if repo.CacheTime == 0 {
+			cfg.Repos[i].CacheTime = 5 * time.Minute
+		}
+		if len(repo.AllowedNames) == 0 {
+			cfg.Repos[i].AllowedNames = defaultAllowedNames
+		}
+	}
+	return &cfg, nil
+}
+
+// defaultAllowedNames is the filename allowlist used when a repo config
+// doesn't specify its own, and for the single-repo environment-variable
+// fallback.
+var defaultAllowedNames = []string{
+	"*.deb",
+	"InRelease",
+	"InRelease.gz",
+	"Release",
+	"Release.gz",
+	"Release.gpg",
+	"Release.gpg.gz",
+	"Packages",
+	"Packages.gz",
+}
+
+// singleRepoConfig builds the default, single-repo configuration from
+// environment variables, used when no CONFIG_FILE is set.
+func singleRepoConfig() *config {
+	return &config{
+		Repos: []repoConfig{
+			{
+				Prefix:    "/dists/",
+				DistsHost: distsHost,
+				ReleasesURLs: []string{
+					"https://api.github.com/repos/syncthing/syncthing/releases?per_page=15",
+					"https://api.github.com/repos/syncthing/discosrv/releases?per_page=5",
+					"https://api.github.com/repos/syncthing/relaysrv/releases?per_page=5",
+				},
+				AllowedNames:    defaultAllowedNames,
+				RefreshInterval: 5 * time.Minute,
+				CacheTime:       5 * time.Minute,
+			},
+		},
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricDiskCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "disk_cache_hits_total",
+	})
+	metricDiskCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "disk_cache_misses_total",
+	})
+	metricDiskCacheRevalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "disk_cache_revalidations_total",
+	})
+	metricDiskCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "disk_cache_evictions_total",
+	})
+	metricDiskCacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "disk_cache_bytes",
+	})
+)
+
+var (
+	diskCacheDir      = os.Getenv("CACHE_DIR")
+	diskCacheMaxBytes = parseByteSize(os.Getenv("CACHE_MAX_BYTES"))
+)
+
+// cacheableNames is the set of APT artifact filenames worth persisting to
+// the disk cache tier; everything else passes straight through to the
+// backend untouched.
+var cacheableNames = []string{
+	"*.deb",
+	"InRelease",
+	"InRelease.gz",
+	"Release",
+	"Release.gz",
+	"Packages",
+	"Packages.gz",
+}
+
+// diskEntry is the on-disk metadata sidecar stored alongside each cached
+// object's body.
+type diskEntry struct {
+	Key          string    `json:"key"`
+	Path         string    `json:"path"` // original request path, e.g. "/dists/stable/Release"
+	ContentType  string    `json:"contentType"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"lastModified"`
+	Size         int64     `json:"size"`
+	StoredAt     time.Time `json:"storedAt"`
+}
+
+type lruItem struct {
+	key   string
+	entry diskEntry
+
+	// needsVerification is set for Release/InRelease entries restored by
+	// warm() from a prior process's metadata: this process's
+	// verifyingProxy hasn't verified them yet, so its in-memory manifest
+	// for their suite is empty. Serving such an entry straight from disk
+	// would leave that manifest unpopulated, failing verification of any
+	// Packages* file that misses the disk cache in the meantime. It's
+	// cleared the moment the entry is next fetched through c.next
+	// (store/refresh), which necessarily re-verifies it.
+	needsVerification bool
+}
+
+// diskCache is a bounded, LRU-evicted on-disk cache tier that sits between
+// the in-memory calmh.dev/proxy layer and the backend object store. A
+// fresh hit (within staleAfter) is served straight from disk without
+// touching the backend; an expired entry is revalidated with the
+// backend's own ETag/Last-Modified so an unchanged body is never
+// re-downloaded. Index state is rebuilt from the metadata sidecars on
+// disk at startup, so a cold restart doesn't need to repopulate from
+// S3 before it's warm again.
+type diskCache struct {
+	dir        string
+	maxBytes   int64
+	staleAfter time.Duration
+	next       http.Handler
+
+	mut   sync.Mutex
+	lru   *list.List
+	index map[string]*list.Element
+	size  int64
+}
+
+func newDiskCache(dir string, maxBytes int64, staleAfter time.Duration, next http.Handler) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		staleAfter: staleAfter,
+		next:       next,
+		lru:        list.New(),
+		index:      make(map[string]*list.Element),
+	}
+	if err := c.warm(); err != nil {
+		slog.Warn("disk cache: failed to warm from existing entries", "dir", dir, "error", err)
+	}
+	return c, nil
+}
+
+func (c *diskCache) warm() error {
+	matches, err := filepath.Glob(filepath.Join(c.dir, "*.meta"))
+	if err != nil {
+		return err
+	}
+	var entries []diskEntry
+	for _, m := range matches {
+		b, err := os.ReadFile(m)
+		if err != nil {
+			continue
+		}
+		var e diskEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			continue
+		}
+		if _, err := os.Stat(c.bodyPath(e.Key)); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].StoredAt.Before(entries[j].StoredAt) })
+	for _, e := range entries {
+		el := c.lru.PushBack(&lruItem{key: e.Key, entry: e, needsVerification: isReleaseFile(path.Base(e.Path))})
+		c.index[e.Key] = el
+		c.size += e.Size
+	}
+	metricDiskCacheBytes.Set(float64(c.size))
+	return nil
+}
+
+func (c *diskCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet || !cacheableName(req.URL.Path) {
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	key := cacheKey(req.URL.Path)
+	c.mut.Lock()
+	el, ok := c.index[key]
+	c.mut.Unlock()
+
+	backendReq := req
+	if ok {
+		item := el.Value.(*lruItem)
+		entry := item.entry
+		if !item.needsVerification && time.Since(entry.StoredAt) < c.staleAfter && c.serveFromDisk(w, req, entry) {
+			c.touch(el)
+			metricDiskCacheHits.Inc()
+			return
+		}
+		if item.needsVerification {
+			// A 304 from the backend bypasses verification, so ask for
+			// the full body instead of revalidating.
+			backendReq = req.Clone(req.Context())
+			backendReq.Header.Del("If-None-Match")
+			backendReq.Header.Del("If-Modified-Since")
+		} else if entry.ETag != "" || entry.LastModified != "" {
+			backendReq = req.Clone(req.Context())
+			if entry.ETag != "" {
+				backendReq.Header.Set("If-None-Match", entry.ETag)
+			}
+			if entry.LastModified != "" {
+				backendReq.Header.Set("If-Modified-Since", entry.LastModified)
+			}
+		}
+	}
+
+	metricDiskCacheMisses.Inc()
+	rec := &cachingResponseWriter{ResponseWriter: w, dir: c.dir, contentLength: -1}
+	c.next.ServeHTTP(rec, backendReq)
+
+	switch rec.status {
+	case http.StatusNotModified:
+		if ok {
+			metricDiskCacheRevalidations.Inc()
+			entry := el.Value.(*lruItem).entry
+			entry.StoredAt = time.Now()
+			c.refresh(el, entry)
+			c.serveFromDisk(w, req, entry)
+		} else {
+			// No disk entry to serve in its place: the 304 answers the
+			// client's own conditional request, so pass it on.
+			w.WriteHeader(http.StatusNotModified)
+		}
+	case http.StatusOK:
+		c.store(key, req.URL.Path, rec)
+	}
+}
+
+func (c *diskCache) serveFromDisk(w http.ResponseWriter, req *http.Request, entry diskEntry) bool {
+	f, err := os.Open(c.bodyPath(entry.Key))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	h := w.Header()
+	if entry.ContentType != "" {
+		h.Set("Content-Type", entry.ContentType)
+	}
+	if entry.ETag != "" {
+		h.Set("ETag", entry.ETag)
+	}
+	http.ServeContent(w, req, entry.Key, entry.StoredAt, f)
+	return true
+}
+
+func (c *diskCache) store(key, reqPath string, rec *cachingResponseWriter) {
+	if rec.tmp == nil {
+		return
+	}
+	tmpPath := rec.tmp.Name()
+	incomplete := rec.incomplete || (rec.contentLength >= 0 && rec.written != rec.contentLength)
+	if err := rec.tmp.Close(); err != nil {
+		slog.Warn("disk cache: failed to close temp file", "error", err)
+		os.Remove(tmpPath)
+		return
+	}
+	if incomplete {
+		slog.Warn("disk cache: response did not complete, not caching", "key", key, "written", rec.written, "contentLength", rec.contentLength)
+		os.Remove(tmpPath)
+		return
+	}
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	bodyPath := c.bodyPath(key)
+	if err := os.Rename(tmpPath, bodyPath); err != nil {
+		slog.Warn("disk cache: failed to finalize entry", "key", key, "error", err)
+		os.Remove(tmpPath)
+		return
+	}
+
+	entry := diskEntry{
+		Key:          key,
+		Path:         reqPath,
+		ContentType:  rec.Header().Get("Content-Type"),
+		ETag:         rec.Header().Get("ETag"),
+		LastModified: rec.Header().Get("Last-Modified"),
+		Size:         info.Size(),
+		StoredAt:     time.Now(),
+	}
+	if err := c.writeMeta(entry); err != nil {
+		slog.Warn("disk cache: failed to persist metadata", "key", key, "error", err)
+	}
+
+	c.mut.Lock()
+	if el, ok := c.index[key]; ok {
+		c.size -= el.Value.(*lruItem).entry.Size
+		el.Value = &lruItem{key: key, entry: entry}
+		c.lru.MoveToBack(el)
+	} else {
+		el := c.lru.PushBack(&lruItem{key: key, entry: entry})
+		c.index[key] = el
+	}
+	c.size += entry.Size
+	c.evictLocked()
+	c.mut.Unlock()
+
+	metricDiskCacheBytes.Set(float64(c.size))
+}
+
+// refresh bumps an entry's StoredAt after a successful revalidation,
+// without touching the body on disk.
+func (c *diskCache) refresh(el *list.Element, entry diskEntry) {
+	c.mut.Lock()
+	el.Value = &lruItem{key: entry.Key, entry: entry}
+	c.lru.MoveToBack(el)
+	c.mut.Unlock()
+	if err := c.writeMeta(entry); err != nil {
+		slog.Warn("disk cache: failed to refresh metadata", "key", entry.Key, "error", err)
+	}
+}
+
+func (c *diskCache) touch(el *list.Element) {
+	c.mut.Lock()
+	c.lru.MoveToBack(el)
+	c.mut.Unlock()
+}
+
+// evictLocked drops the least-recently-used entries until the cache is
+// back under its byte budget. c.mut must be held by the caller.
+func (c *diskCache) evictLocked() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		front := c.lru.Front()
+		item := front.Value.(*lruItem)
+		c.lru.Remove(front)
+		delete(c.index, item.key)
+		c.size -= item.entry.Size
+		os.Remove(c.bodyPath(item.key))
+		os.Remove(c.metaPath(item.key))
+		metricDiskCacheEvictions.Inc()
+	}
+}
+
+func (c *diskCache) writeMeta(entry diskEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := c.metaPath(entry.Key) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.metaPath(entry.Key))
+}
+
+func (c *diskCache) bodyPath(key string) string { return filepath.Join(c.dir, key+".body") }
+func (c *diskCache) metaPath(key string) string { return filepath.Join(c.dir, key+".meta") }
+
+// cachingResponseWriter tees a 200 response body to a temp file on disk
+// as it streams to the client, so large .deb files are never buffered in
+// memory. A 304 revalidation response is instead suppressed entirely;
+// the caller serves the existing disk entry in its place. It also tracks
+// whether the response actually finished, so a client disconnect or an
+// upstream reset mid-transfer doesn't get cached as if it were complete.
+type cachingResponseWriter struct {
+	http.ResponseWriter
+	dir string
+
+	status        int
+	wroteHeader   bool
+	suppress      bool
+	tmp           *os.File
+	contentLength int64 // from the backend's Content-Length header, -1 if absent/unparsable
+	written       int64
+	incomplete    bool
+}
+
+func (w *cachingResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if status == http.StatusNotModified {
+		w.suppress = true
+		return
+	}
+	if w.ResponseWriter.Header().Get(verificationFailedHeader) != "" {
+		// verifyingProxy serves this response to the client regardless
+		// (STRICT_VERIFY may be unset), but it must never land in this
+		// cache tier, so a bad upstream response doesn't get replayed to
+		// every later client for the rest of staleAfter. The header is
+		// internal-only and must not reach the client or any tier above
+		// us, so it's stripped here rather than merely ignored.
+		w.incomplete = true
+		w.ResponseWriter.Header().Del(verificationFailedHeader)
+	}
+	if cl := w.ResponseWriter.Header().Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			w.contentLength = n
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cachingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.suppress {
+		return len(b), nil
+	}
+	if w.status == http.StatusOK && w.tmp == nil && !w.incomplete {
+		if f, err := os.CreateTemp(w.dir, "*.tmp"); err != nil {
+			slog.Warn("disk cache: failed to open temp file for write-through", "error", err)
+		} else {
+			w.tmp = f
+		}
+	}
+	if w.tmp != nil {
+		if _, err := w.tmp.Write(b); err != nil {
+			slog.Warn("disk cache: write-through failed", "error", err)
+			w.tmp.Close()
+			os.Remove(w.tmp.Name())
+			w.tmp = nil
+			w.incomplete = true
+		}
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	if err != nil {
+		w.incomplete = true
+	}
+	return n, err
+}
+
+func cacheableName(p string) bool {
+	name := path.Base(p)
+	for _, pattern := range cacheableNames {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func cacheKey(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheSubdir derives a stable, filesystem-safe directory name for a
+// repo's disk cache, so several repos can share one CACHE_DIR without
+// their keys colliding.
+func cacheSubdir(distsHost string) string {
+	sum := sha256.Sum256([]byte(distsHost))
+	return hex.EncodeToString(sum[:8])
+}
+
+func parseByteSize(s string) int64 {
+	if s == "" {
+		return 1 << 30 // 1 GiB default
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		slog.Warn("invalid CACHE_MAX_BYTES, using default", "value", s)
+		return 1 << 30
+	}
+	return n
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stubHandler serves a fixed response, recording how many times it was
+// invoked so tests can assert whether a request reached the backend or
+// was served from the disk cache.
+type stubHandler struct {
+	calls int
+	fn    func(w http.ResponseWriter, req *http.Request)
+}
+
+func (s *stubHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.calls++
+	s.fn(w, req)
+}
+
+func newTestDiskCache(t *testing.T, maxBytes int64, staleAfter time.Duration, next http.Handler) *diskCache {
+	t.Helper()
+	c, err := newDiskCache(t.TempDir(), maxBytes, staleAfter, next)
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+	return c
+}
+
+func TestDiskCacheStoreAndServeFromDisk(t *testing.T) {
+	stub := &stubHandler{fn: func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Package: foo\n"))
+	}}
+	c := newTestDiskCache(t, 1<<20, time.Hour, stub)
+
+	req := httptest.NewRequest(http.MethodGet, "/dists/stable/main/binary-amd64/Packages", nil)
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "Package: foo\n" {
+		t.Fatalf("first request: got %d %q", rec.Code, rec.Body.String())
+	}
+	if stub.calls != 1 {
+		t.Fatalf("expected 1 backend call, got %d", stub.calls)
+	}
+
+	rec2 := httptest.NewRecorder()
+	c.ServeHTTP(rec2, httptest.NewRequest(http.MethodGet, "/dists/stable/main/binary-amd64/Packages", nil))
+	if rec2.Code != http.StatusOK || rec2.Body.String() != "Package: foo\n" {
+		t.Fatalf("second request: got %d %q", rec2.Code, rec2.Body.String())
+	}
+	if stub.calls != 1 {
+		t.Fatalf("expected second request to be served from disk, backend called %d times", stub.calls)
+	}
+}
+
+func TestDiskCacheSkipsIncompleteResponse(t *testing.T) {
+	stub := &stubHandler{fn: func(w http.ResponseWriter, req *http.Request) {
+		// Claim more bytes than we actually write, as a disconnect or
+		// upstream reset mid-transfer would.
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("short"))
+	}}
+	c := newTestDiskCache(t, 1<<20, time.Hour, stub)
+
+	req := httptest.NewRequest(http.MethodGet, "/dists/stable/Packages", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+	if stub.calls != 1 {
+		t.Fatalf("expected 1 backend call, got %d", stub.calls)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dists/stable/Packages", nil))
+	if stub.calls != 2 {
+		t.Fatalf("expected incomplete response not to be cached, backend called %d times, want 2", stub.calls)
+	}
+}
+
+func TestDiskCacheSkipsVerificationFailedResponse(t *testing.T) {
+	stub := &stubHandler{fn: func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(verificationFailedHeader, "1")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Package: foo\n"))
+	}}
+	c := newTestDiskCache(t, 1<<20, time.Hour, stub)
+
+	req := httptest.NewRequest(http.MethodGet, "/dists/stable/Packages", nil)
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "Package: foo\n" {
+		t.Fatalf("client should still be served: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get(verificationFailedHeader) != "" {
+		t.Fatalf("internal verification-failed header leaked to the client")
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dists/stable/Packages", nil))
+	if stub.calls != 2 {
+		t.Fatalf("expected verification failure not to be cached, backend called %d times, want 2", stub.calls)
+	}
+}
+
+func TestDiskCacheRevalidatesStaleEntry(t *testing.T) {
+	first := true
+	stub := &stubHandler{fn: func(w http.ResponseWriter, req *http.Request) {
+		if !first {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		first = false
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Package: foo\n"))
+	}}
+	c := newTestDiskCache(t, 1<<20, 0, stub) // staleAfter=0: every hit revalidates
+
+	path := "/dists/stable/Packages"
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "Package: foo\n" {
+		t.Fatalf("revalidated entry should still serve the cached body: got %d %q", rec.Code, rec.Body.String())
+	}
+	if stub.calls != 2 {
+		t.Fatalf("expected backend to be consulted for revalidation, got %d calls", stub.calls)
+	}
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	body := make([]byte, 100)
+	stub := &stubHandler{fn: func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}}
+	c := newTestDiskCache(t, 150, time.Hour, stub) // room for ~1.5 entries
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dists/stable/Packages", nil))
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dists/stable/Release", nil))
+
+	c.mut.Lock()
+	_, firstStillCached := c.index[cacheKey("/dists/stable/Packages")]
+	_, secondStillCached := c.index[cacheKey("/dists/stable/Release")]
+	c.mut.Unlock()
+
+	if firstStillCached {
+		t.Fatalf("expected the least-recently-used entry to be evicted")
+	}
+	if !secondStillCached {
+		t.Fatalf("expected the most recently stored entry to remain cached")
+	}
+}
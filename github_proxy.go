@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
@@ -26,15 +28,47 @@ var (
 	metricGithubRedirectAssets = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "github_proxy_redirect_assets_loaded",
 	})
+	metricGithubPollFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "github_proxy_poll_failures_total",
+	})
+	metricGithubLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "github_proxy_last_successful_refresh_timestamp_seconds",
+	})
+	metricGithubBackoffSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "github_proxy_backoff_seconds",
+	})
+	// metricDistsSource tracks whether /dists/ requests end up redirected
+	// to GitHub or proxied to the backend object store, so a drop in the
+	// redirect share (GitHub asset names drifting from what APT asks for)
+	// shows up as a trend rather than silently falling back to S3.
+	metricDistsSource = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apt_dists_requests_total",
+	}, []string{"source"})
 )
 
+// maxGithubBackoff caps how stale our view of GitHub releases is allowed
+// to get while GitHub (or our network path to it) is unhappy.
+const maxGithubBackoff = 30 * time.Minute
+
 type githubRedirector struct {
 	releasesURLs    []string
 	refreshInterval time.Duration
+	githubToken     string
+	httpClient      *http.Client
 	next            http.Handler
 
 	mut    sync.Mutex
 	assets map[string]asset
+
+	pollMut sync.Mutex
+	polled  map[string]*urlPollState
+}
+
+// urlPollState tracks per-releasesURL revalidation state, so an unchanged
+// release list costs a 304 instead of a full re-download and re-decode.
+type urlPollState struct {
+	etag   string
+	assets map[string]asset
 }
 
 type asset struct {
@@ -52,42 +86,129 @@ func (r *githubRedirector) Serve(ctx context.Context) error {
 	slog.Info("starting GitHub redirector")
 	defer slog.Info("stopping GitHub redirector")
 
+	backoff := r.refreshInterval
 	timer := time.NewTimer(0)
 	defer timer.Stop()
 	for {
 		select {
 		case <-timer.C:
-			newAssets := make(map[string]asset)
-			nonUnique := make(map[string]struct{})
-			for _, url := range r.releasesURLs {
-				assets, err := r.fetchGithubReleaseAssets(ctx, url)
-				if err != nil {
-					return err
-				}
-				for key, asset := range assets {
-					if _, ok := nonUnique[key]; ok {
-						continue
-					}
-					if _, ok := newAssets[key]; ok {
-						nonUnique[key] = struct{}{}
-						delete(newAssets, key)
-						slog.Info("skipping non-unique asset", "key", key)
-						continue
-					}
-					newAssets[key] = asset
+			rateLimitWait, err := r.poll(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
 				}
+				metricGithubPollFailures.Inc()
+				backoff = nextBackoff(backoff, r.refreshInterval, maxGithubBackoff)
+				slog.Warn("failed to refresh GitHub release assets, keeping last known set", "error", err, "retryIn", backoff)
+			} else {
+				backoff = r.refreshInterval
+				metricGithubLastSuccess.SetToCurrentTime()
 			}
-			r.mut.Lock()
-			r.assets = newAssets
-			r.mut.Unlock()
-			metricGithubRedirectAssets.Set(float64(len(newAssets)))
-			timer.Reset(r.refreshInterval)
+			// A rate limit on this poll pushes the next one out regardless
+			// of whether the poll itself succeeded, so we don't hold back
+			// data we already have in hand just to wait out the window.
+			if rateLimitWait > backoff {
+				backoff = rateLimitWait
+			}
+			metricGithubBackoffSeconds.Set(backoff.Seconds())
+			timer.Reset(backoff)
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
 }
 
+// poll refreshes the asset map from every configured releases URL. A
+// failure or 304 on one URL falls back to that URL's last known assets
+// rather than failing the whole poll, so a single flaky upstream doesn't
+// take down redirects for the others. The first error encountered, if
+// any, is returned so the caller can drive backoff — but the combined
+// asset map is always updated with whatever we do have. It also returns
+// the longest rate limit wait reported by any URL, so the caller can
+// push out the next poll without delaying the assets we already fetched.
+func (r *githubRedirector) poll(ctx context.Context) (rateLimitWait time.Duration, err error) {
+	newAssets := make(map[string]asset)
+	nonUnique := make(map[string]struct{})
+	var firstErr error
+	for _, releasesURL := range r.releasesURLs {
+		st := r.stateFor(releasesURL)
+		assets, notModified, wait, err := r.fetchGithubReleaseAssets(ctx, releasesURL, st)
+		if wait > rateLimitWait {
+			rateLimitWait = wait
+		}
+		switch {
+		case err != nil:
+			if firstErr == nil {
+				firstErr = err
+			}
+			slog.Warn("failed to poll GitHub releases", "url", releasesURL, "error", err)
+			assets = st.assets
+		case notModified:
+			assets = st.assets
+		default:
+			st.assets = assets
+		}
+		for key, asset := range assets {
+			if _, ok := nonUnique[key]; ok {
+				continue
+			}
+			if _, ok := newAssets[key]; ok {
+				nonUnique[key] = struct{}{}
+				delete(newAssets, key)
+				slog.Info("skipping non-unique asset", "key", key)
+				continue
+			}
+			newAssets[key] = asset
+		}
+	}
+
+	r.mut.Lock()
+	r.assets = newAssets
+	r.mut.Unlock()
+	metricGithubRedirectAssets.Set(float64(len(newAssets)))
+
+	return rateLimitWait, firstErr
+}
+
+// client returns the configured outbound HTTP client, falling back to
+// http.DefaultClient so a zero-value githubRedirector remains usable.
+func (r *githubRedirector) client() *http.Client {
+	if r.httpClient != nil {
+		return r.httpClient
+	}
+	return http.DefaultClient
+}
+
+func (r *githubRedirector) stateFor(releasesURL string) *urlPollState {
+	r.pollMut.Lock()
+	defer r.pollMut.Unlock()
+	if r.polled == nil {
+		r.polled = make(map[string]*urlPollState)
+	}
+	st, ok := r.polled[releasesURL]
+	if !ok {
+		st = &urlPollState{}
+		r.polled[releasesURL] = st
+	}
+	return st
+}
+
+// nextBackoff doubles the current interval and clamps it to [base, max],
+// then returns a random duration between half of that and the full value,
+// so many instances polling the same releases URL don't all retry in
+// lockstep. The jitter can take the result below base, never above max.
+func nextBackoff(current, base, max time.Duration) time.Duration {
+	next := current * 2
+	if next < base {
+		next = base
+	}
+	if next > max {
+		next = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(next)/2 + 1))
+	return next/2 + jitter
+}
+
 func (r *githubRedirector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	file := path.Base(req.URL.Path)
 	if unesc, err := url.PathUnescape(file); err == nil {
@@ -103,12 +224,14 @@ func (r *githubRedirector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	r.mut.Unlock()
 
 	if !ok {
+		metricDistsSource.WithLabelValues("proxy").Inc()
 		r.next.ServeHTTP(w, req)
 		return
 	}
 
 	if r.buggyAPTVersion(req) {
 		slog.Info("serving proxied for buggy APT", "file", file, "ua", req.Header.Get("User-Agent"))
+		metricDistsSource.WithLabelValues("proxy").Inc()
 		r.next.ServeHTTP(w, req)
 		return
 	}
@@ -117,30 +240,84 @@ func (r *githubRedirector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, asset.BrowserURL, http.StatusTemporaryRedirect)
 	metricGithubRedirects.Inc()
 	metricGithubRedirectBytes.Add(float64(asset.Size))
+	metricDistsSource.WithLabelValues("redirect").Inc()
 }
 
-func (r *githubRedirector) fetchGithubReleaseAssets(ctx context.Context, url string) (map[string]asset, error) {
+// fetchGithubReleaseAssets fetches and decodes the release list at url. It
+// sends the last known ETag so an unchanged list costs a 304 (reported via
+// the notModified return) instead of a full re-decode. If the response
+// indicates a rate limit, it's reported via rateLimitWait rather than
+// slept out here, so a response we already have in hand isn't held back
+// from the caller; it's up to the caller to fold that wait into backoff
+// before the next poll.
+func (r *githubRedirector) fetchGithubReleaseAssets(ctx context.Context, url string, st *urlPollState) (assets map[string]asset, notModified bool, rateLimitWait time.Duration, err error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, 0, err
+	}
+	if st.etag != "" {
+		req.Header.Set("If-None-Match", st.etag)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if r.githubToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.githubToken)
+	}
+
+	resp, err := r.client().Do(req)
 	if err != nil {
-		return nil, err
+		return nil, false, 0, err
 	}
 	defer resp.Body.Close()
+
+	rateLimitWait = githubRateLimitWait(resp.Header)
+	if rateLimitWait > 0 {
+		slog.Warn("GitHub rate limit reached, deferring next poll", "url", url, "wait", rateLimitWait)
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, true, rateLimitWait, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, rateLimitWait, fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		st.etag = etag
+	}
+
 	var rels []release
 	if err := json.NewDecoder(resp.Body).Decode(&rels); err != nil {
-		return nil, err
+		return nil, false, rateLimitWait, err
 	}
 
-	assets := make(map[string]asset)
+	assets = make(map[string]asset)
 	for _, rel := range rels {
 		for _, asset := range rel.Assets {
 			assets[asset.Name] = asset
 		}
 	}
-	return assets, nil
+	return assets, false, rateLimitWait, nil
+}
+
+// githubRateLimitWait returns how long to sleep before retrying, based on
+// a Retry-After header or an exhausted X-RateLimit-Remaining budget. It
+// returns 0 if the response doesn't indicate any rate limiting.
+func githubRateLimitWait(h http.Header) time.Duration {
+	if ra := h.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(ra); err == nil {
+			return time.Until(t)
+		}
+	}
+	if h.Get("X-RateLimit-Remaining") == "0" {
+		if reset := h.Get("X-RateLimit-Reset"); reset != "" {
+			if secs, err := strconv.ParseInt(reset, 10, 64); err == nil {
+				return time.Until(time.Unix(secs, 0))
+			}
+		}
+	}
+	return 0
 }
 
 // buggyAPTVersion returns true for APT versions that can't properly handle
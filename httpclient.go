@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+var (
+	outboundProxyURL  = os.Getenv("OUTBOUND_PROXY_URL")
+	outboundProxyUser = os.Getenv("OUTBOUND_PROXY_USER")
+	outboundProxyPass = os.Getenv("OUTBOUND_PROXY_PASSWORD")
+	outboundProxyCA   = os.Getenv("OUTBOUND_PROXY_CA_FILE")
+)
+
+// newOutboundTransport builds the *http.Transport used for every outbound
+// request we make: GitHub API polling and the reverse proxy to the
+// backend object store. Cloning http.DefaultTransport already gives us
+// http.ProxyFromEnvironment, so HTTP_PROXY/HTTPS_PROXY/NO_PROXY are
+// honored without further work; OUTBOUND_PROXY_URL overrides that with an
+// explicit proxy (with optional basic auth), and OUTBOUND_PROXY_CA_FILE
+// adds a custom CA bundle for proxies that intercept TLS.
+func newOutboundTransport() (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if outboundProxyURL != "" {
+		proxyURL, err := url.Parse(outboundProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing OUTBOUND_PROXY_URL: %w", err)
+		}
+		if outboundProxyUser != "" {
+			proxyURL.User = url.UserPassword(outboundProxyUser, outboundProxyPass)
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if outboundProxyCA != "" {
+		pem, err := os.ReadFile(outboundProxyCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading OUTBOUND_PROXY_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in OUTBOUND_PROXY_CA_FILE")
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return t, nil
+}
+
+// logOutboundProxyConfig logs whether outbound requests are routed through
+// a proxy, so a misconfigured egress path is obvious at startup rather
+// than surfacing later as confusing connection failures.
+func logOutboundProxyConfig() {
+	if outboundProxyURL != "" {
+		slog.Info("outbound proxy configured", "url", outboundProxyURL, "source", "OUTBOUND_PROXY_URL")
+		return
+	}
+	for _, env := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if v := os.Getenv(env); v != "" {
+			slog.Info("outbound proxy configured", "source", env)
+			return
+		}
+	}
+	slog.Info("no outbound proxy configured")
+}
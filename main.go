@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"time"
 
 	"calmh.dev/proxy"
@@ -25,6 +26,8 @@ var (
 	listenAddr        = cmp.Or(os.Getenv("LISTEN_ADDRESS"), ":8080")
 	metricsListenAddr = cmp.Or(os.Getenv("LISTEN_ADDRESS"), ":8081")
 	distsHost         = cmp.Or(os.Getenv("DISTS_HOST"), "https://syncthing-apt.s3.fr-par.scw.cloud")
+	configFile        = os.Getenv("CONFIG_FILE")
+	githubToken       = os.Getenv("GITHUB_TOKEN")
 )
 
 func main() {
@@ -33,44 +36,41 @@ func main() {
 	// The built in FS serves static files from memory
 	subFS, _ := fs.Sub(fs.FS(siteFS), "site")
 	site := http.FS(subFS)
-	http.Handle("/", http.FileServer(site))
+	http.Handle("/", instrument("site", http.FileServer(site)))
 
-	// The caching proxy serves files from the backend object store
-	proxy, err := newCachingProxy(distsHost, 5*time.Minute)
+	// Shared across the GitHub poller and the backend reverse proxy, so
+	// both honor HTTP_PROXY/HTTPS_PROXY/NO_PROXY (or an explicit outbound
+	// proxy config) the same way.
+	transport, err := newOutboundTransport()
 	if err != nil {
-		slog.Error("failed to construct proxy", "error", err)
+		slog.Error("failed to configure outbound transport", "error", err)
 		os.Exit(2)
 	}
-
-	// The GitHub redirector serves assets from GitHub releases
-	github := &githubRedirector{
-		releasesURLs: []string{
-			"https://api.github.com/repos/syncthing/syncthing/releases?per_page=15",
-			"https://api.github.com/repos/syncthing/discosrv/releases?per_page=5",
-			"https://api.github.com/repos/syncthing/relaysrv/releases?per_page=5",
-		},
-		refreshInterval: 5 * time.Minute,
-		next:            proxy,
+	logOutboundProxyConfig()
+
+	// Multiple logical APT repositories (stable, candidate, nightly, ...)
+	// can be served from one process, each mounted under its own prefix.
+	// With no CONFIG_FILE, we fall back to a single repo configured from
+	// environment variables, matching prior behavior.
+	cfg := singleRepoConfig()
+	if configFile != "" {
+		cfg, err = loadConfig(configFile)
+		if err != nil {
+			slog.Error("failed to load config", "path", configFile, "error", err)
+			os.Exit(2)
+		}
 	}
-	main.Add(github)
 
-	// We slightly filter which files we're willing to even try to serve
-	filtered := validateFilename(github, []string{
-		"*.deb",
-		"InRelease",
-		"InRelease.gz",
-		"Release",
-		"Release.gz",
-		"Release.gpg",
-		"Release.gpg.gz",
-		"Packages",
-		"Packages.gz",
-	})
-	http.Handle("/dists/", filtered)
+	for _, repo := range cfg.Repos {
+		if err := mountRepo(main, repo, transport); err != nil {
+			slog.Error("failed to mount repo", "prefix", repo.Prefix, "error", err)
+			os.Exit(2)
+		}
+	}
 
 	main.Add(asService(func(_ context.Context) error {
 		slog.Info("starting metrics listener", "addr", metricsListenAddr)
-		return http.ListenAndServe(metricsListenAddr, promhttp.Handler())
+		return http.ListenAndServe(metricsListenAddr, instrument("metrics", promhttp.Handler()))
 	}))
 
 	main.Add(asService(func(_ context.Context) error {
@@ -81,6 +81,30 @@ func main() {
 	main.Serve(context.Background())
 }
 
+// mountRepo wires up a proxy and GitHub redirector for a single repo
+// config and mounts them under repo.Prefix on the default mux.
+func mountRepo(main *suture.Supervisor, repo repoConfig, transport *http.Transport) error {
+	proxy, err := newCachingProxy(repo.DistsHost, repo.CacheTime, transport)
+	if err != nil {
+		return err
+	}
+
+	github := &githubRedirector{
+		releasesURLs:    repo.ReleasesURLs,
+		refreshInterval: repo.RefreshInterval,
+		githubToken:     githubToken,
+		httpClient:      &http.Client{Transport: transport},
+		next:            proxy,
+	}
+	main.Add(github)
+
+	// We slightly filter which files we're willing to even try to serve
+	filtered := validateFilename(github, repo.AllowedNames)
+	http.Handle(repo.Prefix, instrument("dists", filtered))
+
+	return nil
+}
+
 func validateFilename(next http.Handler, names []string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		name := path.Base(req.URL.Path)
@@ -94,7 +118,7 @@ func validateFilename(next http.Handler, names []string) http.Handler {
 	})
 }
 
-func newCachingProxy(next string, cacheTime time.Duration) (http.Handler, error) {
+func newCachingProxy(next string, cacheTime time.Duration, transport *http.Transport) (http.Handler, error) {
 	remote, err := url.Parse(next)
 	if err != nil {
 		return nil, err
@@ -103,9 +127,43 @@ func newCachingProxy(next string, cacheTime time.Duration) (http.Handler, error)
 		Rewrite: func(r *httputil.ProxyRequest) {
 			r.SetURL(remote)
 		},
+		Transport: transport,
+	}
+
+	// The in-memory proxy.New cache is the hot tier; on miss we fall
+	// through an optional bounded on-disk tier before hitting the
+	// backend object store itself. Verification runs innermost, right
+	// against what the backend returned, so a failure never makes it
+	// into the disk tier (diskCache.store respects a failed verification
+	// regardless of strict mode; see verify.go). proxy.New itself only
+	// ever sees "cache this 200" with no way to override that per
+	// response, so Release/InRelease/Packages* requests — the only ones
+	// verification can fail for — bypass it entirely and go straight to
+	// the disk tier/backend; everything else still gets its hot caching.
+	var backend http.Handler = rev
+	verifying, err := newVerifyingProxy(backend)
+	if err != nil {
+		return nil, err
+	}
+	backend = verifying
+
+	if diskCacheDir != "" {
+		dc, err := newDiskCache(filepath.Join(diskCacheDir, cacheSubdir(next)), diskCacheMaxBytes, cacheTime, backend)
+		if err != nil {
+			return nil, err
+		}
+		backend = dc
 	}
 
-	return proxy.New(cacheTime, 100, rev), nil
+	cached := proxy.New(cacheTime, 100, backend)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := path.Base(req.URL.Path)
+		if isReleaseFile(name) || isPackagesFile(name) {
+			backend.ServeHTTP(w, req)
+			return
+		}
+		cached.ServeHTTP(w, req)
+	}), nil
 }
 
 type asService func(ctx context.Context) error
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricHTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+	}, []string{"handler", "method", "status"})
+	metricHTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "http_request_duration_seconds",
+		// APT requests are mostly small metadata fetches with an
+		// occasional large .deb download, so we bias buckets towards
+		// sub-second latency while still covering slow transfers.
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"handler", "method"})
+	metricHTTPResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_response_size_bytes",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"handler"})
+	metricHTTPInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_in_flight_requests",
+	}, []string{"handler"})
+)
+
+// instrument wraps next with request counters, a latency histogram, a
+// response-size histogram, and an in-flight gauge. handlerName is a fixed,
+// low-cardinality symbolic name ("site", "dists", "metrics") rather than
+// the raw request path, to keep label cardinality bounded.
+func instrument(handlerName string, next http.Handler) http.Handler {
+	inFlight := metricHTTPInFlight.WithLabelValues(handlerName)
+	duration := metricHTTPDuration.MustCurryWith(prometheus.Labels{"handler": handlerName})
+	size := metricHTTPResponseSize.WithLabelValues(handlerName)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		metricHTTPRequests.WithLabelValues(handlerName, req.Method, strconv.Itoa(rec.status)).Inc()
+		duration.WithLabelValues(req.Method).Observe(time.Since(start).Seconds())
+		size.Observe(float64(rec.size))
+	})
+}
+
+// statusRecorder captures the status code and body size of a response so
+// they can be attached to metrics after the handler has run.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	size        int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
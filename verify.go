@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+//go:embed keys
+var trustedKeysFS embed.FS
+
+var (
+	// strictVerify fails requests closed on any verification failure.
+	// Left unset, failures are logged and metered but the response is
+	// still served, so the feature can be rolled out safely before
+	// trusting it to take the repo down on a bad signature.
+	strictVerify = os.Getenv("STRICT_VERIFY") == "1"
+
+	metricVerificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apt_release_verification_failures_total",
+	}, []string{"reason"})
+)
+
+// verificationFailedHeader is set internally on a verification failure so
+// a wrapping cache tier (diskCache) knows to skip storing the response,
+// regardless of strictVerify — caching is never allowed to depend on
+// whether we merely log-and-serve or fail closed. diskCache strips it from
+// the responses it caches, so those never carry it to another cache tier
+// or the client. With no disk tier (CACHE_DIR unset), or for a Packages*
+// name outside cacheableNames, nothing strips it and the client gets it.
+const verificationFailedHeader = "X-Apt-Web-Verification-Failed"
+
+// maxManifestRoots bounds how many suites/components worth of Release
+// manifests verifyingProxy remembers at once, so a repo with many suites
+// can't grow this without bound; the oldest is evicted first.
+const maxManifestRoots = 64
+
+// verifyingProxy sits between the backend object store and the cache
+// tiers. It verifies Release/InRelease responses against a trusted GPG
+// keyring and remembers the SHA256 each lists for its Packages* files, so
+// a later Packages* response can be checked against that manifest before
+// it's allowed into the cache. With no trusted keys configured it's a
+// no-op passthrough.
+type verifyingProxy struct {
+	next    http.Handler
+	keyring openpgp.EntityList
+
+	mut       sync.Mutex
+	manifests map[string]map[string]string // suite root -> path relative to root -> expected sha256 hex
+	order     []string                     // manifests keys, oldest first, for eviction
+}
+
+func newVerifyingProxy(next http.Handler) (*verifyingProxy, error) {
+	keyring, err := loadTrustedKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 {
+		slog.Info("no trusted release-signing keys configured, verification disabled")
+	} else {
+		slog.Info("release verification enabled", "keys", len(keyring), "strict", strictVerify)
+	}
+	return &verifyingProxy{next: next, keyring: keyring}, nil
+}
+
+func loadTrustedKeyring() (openpgp.EntityList, error) {
+	entries, err := trustedKeysFS.ReadDir("keys")
+	if err != nil {
+		return nil, err
+	}
+	var keyring openpgp.EntityList
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".asc") {
+			continue
+		}
+		b, err := trustedKeysFS.ReadFile(path.Join("keys", e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", e.Name(), err)
+		}
+		ring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+		if err != nil {
+			slog.Warn("skipping unparsable trusted key", "file", e.Name(), "error", err)
+			continue
+		}
+		keyring = append(keyring, ring...)
+	}
+	return keyring, nil
+}
+
+func (v *verifyingProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(v.keyring) == 0 || req.Method != http.MethodGet {
+		v.next.ServeHTTP(w, req)
+		return
+	}
+
+	name := path.Base(req.URL.Path)
+	if !isReleaseFile(name) && !isPackagesFile(name) {
+		v.next.ServeHTTP(w, req)
+		return
+	}
+
+	rec := newBufferingResponseWriter()
+	v.next.ServeHTTP(rec, req)
+
+	var failed bool
+	if rec.status == http.StatusOK {
+		if err := v.verify(req, name, rec.body.Bytes()); err != nil {
+			reason := "other"
+			switch {
+			case strings.Contains(err.Error(), "signature"):
+				reason = "bad_signature"
+			case strings.Contains(err.Error(), "sha256"):
+				reason = "hash_mismatch"
+			case strings.Contains(err.Error(), "manifest"):
+				reason = "no_manifest"
+			}
+			metricVerificationFailures.WithLabelValues(reason).Inc()
+			if strictVerify {
+				slog.Error("refusing to serve unverified release metadata", "file", name, "error", err)
+				http.Error(w, "release metadata failed verification", http.StatusBadGateway)
+				return
+			}
+			failed = true
+			slog.Warn("release metadata failed verification, serving anyway (STRICT_VERIFY not set)", "file", name, "error", err)
+		}
+	}
+
+	for k, vs := range rec.header {
+		w.Header()[k] = vs
+	}
+	if failed {
+		// The client still gets served (strictVerify is off), but no
+		// cache tier wrapping us is allowed to keep this copy around.
+		w.Header().Set(verificationFailedHeader, "1")
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
+
+func (v *verifyingProxy) verify(req *http.Request, name string, body []byte) error {
+	switch {
+	case name == "InRelease":
+		manifest, err := v.verifyClearsigned(body)
+		if err != nil {
+			return err
+		}
+		v.setManifest(path.Dir(req.URL.Path), manifest)
+		return nil
+
+	case name == "Release":
+		sig, err := v.fetchSibling(req, "Release.gpg")
+		if err != nil {
+			return fmt.Errorf("fetching detached signature: %w", err)
+		}
+		if _, err := openpgp.CheckDetachedSignature(v.keyring, bytes.NewReader(body), bytes.NewReader(sig)); err != nil {
+			return fmt.Errorf("signature: %w", err)
+		}
+		manifest, err := parseReleaseManifest(body)
+		if err != nil {
+			return fmt.Errorf("manifest: %w", err)
+		}
+		v.setManifest(path.Dir(req.URL.Path), manifest)
+		return nil
+
+	case isPackagesFile(name):
+		key, expected, ok := v.lookupManifest(req.URL.Path)
+		if !ok {
+			return fmt.Errorf("manifest: no verified release manifest entry for %s", req.URL.Path)
+		}
+		sum := sha256.Sum256(body)
+		if got := hex.EncodeToString(sum[:]); got != expected {
+			return fmt.Errorf("sha256 mismatch for %s: got %s, want %s", key, got, expected)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+func (v *verifyingProxy) verifyClearsigned(body []byte) (map[string]string, error) {
+	block, _ := clearsign.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("signature: not a clearsigned message")
+	}
+	if _, err := openpgp.CheckDetachedSignature(v.keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	manifest, err := parseReleaseManifest(block.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// setManifest records the manifest verified from a Release/InRelease
+// under root (its directory), keyed independently of any other suite's
+// manifest, so one repo serving several suites/components/archs doesn't
+// have concurrent Release fetches for different suites clobber each
+// other's manifest. Oldest root is evicted once maxManifestRoots is
+// exceeded.
+func (v *verifyingProxy) setManifest(root string, manifest map[string]string) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	if v.manifests == nil {
+		v.manifests = make(map[string]map[string]string)
+	}
+	if _, exists := v.manifests[root]; !exists {
+		v.order = append(v.order, root)
+	}
+	v.manifests[root] = manifest
+	for len(v.order) > maxManifestRoots {
+		oldest := v.order[0]
+		v.order = v.order[1:]
+		delete(v.manifests, oldest)
+	}
+}
+
+// lookupManifest finds the manifest whose suite root is the longest
+// matching prefix of p (the request path of a Packages* file) and looks
+// up p's expected sha256 within it, keyed relative to that root — e.g.
+// "main/binary-amd64/Packages" rather than just "Packages".
+func (v *verifyingProxy) lookupManifest(p string) (key, expected string, ok bool) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	var root string
+	for candidate := range v.manifests {
+		if candidate == p || strings.HasPrefix(p, candidate+"/") {
+			if len(candidate) > len(root) {
+				root = candidate
+			}
+		}
+	}
+	manifest, exists := v.manifests[root]
+	if !exists {
+		return "", "", false
+	}
+	key = strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+	expected, ok = manifest[key]
+	return key, expected, ok
+}
+
+// fetchSibling fetches another file in the same directory as req (e.g.
+// Release.gpg alongside Release) through the same handler chain.
+func (v *verifyingProxy) fetchSibling(req *http.Request, name string) ([]byte, error) {
+	sibling := req.Clone(req.Context())
+	u := *req.URL
+	u.Path = path.Join(path.Dir(req.URL.Path), name)
+	sibling.URL = &u
+
+	rec := newBufferingResponseWriter()
+	v.next.ServeHTTP(rec, sibling)
+	if rec.status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", rec.status, name)
+	}
+	return rec.body.Bytes(), nil
+}
+
+// bufferingResponseWriter buffers a response in full so verify can inspect
+// the complete body before deciding whether to release it to the real
+// client. Unlike the streamed .deb path in diskcache.go, Release/
+// InRelease/Packages files are small metadata, so buffering here is fine.
+type bufferingResponseWriter struct {
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func newBufferingResponseWriter() *bufferingResponseWriter {
+	return &bufferingResponseWriter{header: make(http.Header), status: http.StatusOK}
+}
+
+func (w *bufferingResponseWriter) Header() http.Header { return w.header }
+
+func (w *bufferingResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+}
+
+func (w *bufferingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(b)
+}
+
+// parseReleaseManifest extracts the filename -> sha256 mapping from the
+// "SHA256:" section of an APT Release file.
+func parseReleaseManifest(body []byte) (map[string]string, error) {
+	manifest := make(map[string]string)
+	inSHA256 := false
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "SHA256:" {
+			inSHA256 = true
+			continue
+		}
+		if line == "" || (line[0] != ' ' && line[0] != '\t') {
+			inSHA256 = false
+			continue
+		}
+		if !inSHA256 {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		manifest[fields[2]] = fields[0]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("no SHA256 section found")
+	}
+	return manifest, nil
+}
+
+func isReleaseFile(name string) bool {
+	return name == "Release" || name == "InRelease"
+}
+
+func isPackagesFile(name string) bool {
+	return strings.HasPrefix(name, "Packages")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+func testRelease(t *testing.T) (signingEntity *openpgp.Entity, releaseBody []byte) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("apt-web test", "", "test@example.invalid", nil)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+	body := "Suite: stable\n" +
+		"SHA256:\n" +
+		" 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7a 13 main/binary-amd64/Packages\n"
+	return entity, []byte(body)
+}
+
+// newVerifyingTestProxy builds a verifyingProxy backed by a stub handler
+// that serves a real, signed Release+Release.gpg pair (and Release.gpg's
+// sibling fetch), so ServeHTTP exercises the actual GPG verification path
+// end to end rather than just the manifest bookkeeping around it.
+func newVerifyingTestProxy(t *testing.T) (*verifyingProxy, []byte) {
+	t.Helper()
+	entity, releaseBody := testRelease(t)
+
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, entity, bytes.NewReader(releaseBody), nil); err != nil {
+		t.Fatalf("signing test release: %v", err)
+	}
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/dists/stable/Release":
+			w.Write(releaseBody)
+		case "/dists/stable/Release.gpg":
+			w.Write(sig.Bytes())
+		default:
+			http.NotFound(w, req)
+		}
+	})
+
+	return &verifyingProxy{next: backend, keyring: openpgp.EntityList{entity}}, releaseBody
+}
+
+func TestVerifyingProxyAcceptsValidSignature(t *testing.T) {
+	v, _ := newVerifyingTestProxy(t)
+
+	rec := httptest.NewRecorder()
+	v.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dists/stable/Release", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if rec.Header().Get(verificationFailedHeader) != "" {
+		t.Fatalf("valid signature should not be flagged as a verification failure")
+	}
+
+	if _, _, ok := v.lookupManifest("/dists/stable/main/binary-amd64/Packages"); !ok {
+		t.Fatalf("expected the Release's manifest to be recorded after verification")
+	}
+}
+
+func TestVerifyingProxyRejectsUntrustedSignature(t *testing.T) {
+	v, _ := newVerifyingTestProxy(t)
+	other, err := openpgp.NewEntity("someone else", "", "other@example.invalid", nil)
+	if err != nil {
+		t.Fatalf("generating second test key: %v", err)
+	}
+	v.keyring = openpgp.EntityList{other} // swap out the trusted key after signing
+
+	rec := httptest.NewRecorder()
+	v.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dists/stable/Release", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("non-strict mode should still serve the client, got %d", rec.Code)
+	}
+	if rec.Header().Get(verificationFailedHeader) != "1" {
+		t.Fatalf("expected the verification-failed sentinel to be set")
+	}
+}
+
+func TestVerifyingProxyRejectsUntrustedSignatureStrict(t *testing.T) {
+	v, _ := newVerifyingTestProxy(t)
+	other, err := openpgp.NewEntity("someone else", "", "other@example.invalid", nil)
+	if err != nil {
+		t.Fatalf("generating second test key: %v", err)
+	}
+	v.keyring = openpgp.EntityList{other}
+
+	strictVerify = true
+	defer func() { strictVerify = false }()
+
+	rec := httptest.NewRecorder()
+	v.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dists/stable/Release", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 under STRICT_VERIFY, got %d", rec.Code)
+	}
+}
+
+func TestVerifyingProxyClearsignedRoundTrip(t *testing.T) {
+	entity, releaseBody := testRelease(t)
+
+	var signed bytes.Buffer
+	w, err := clearsign.Encode(&signed, entity.PrivateKey, nil)
+	if err != nil {
+		t.Fatalf("clearsign.Encode: %v", err)
+	}
+	if _, err := w.Write(releaseBody); err != nil {
+		t.Fatalf("writing clearsigned body: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing clearsign writer: %v", err)
+	}
+
+	v := &verifyingProxy{keyring: openpgp.EntityList{entity}}
+	manifest, err := v.verifyClearsigned(signed.Bytes())
+	if err != nil {
+		t.Fatalf("verifyClearsigned: %v", err)
+	}
+	if manifest["main/binary-amd64/Packages"] == "" {
+		t.Fatalf("expected manifest entry for main/binary-amd64/Packages, got %v", manifest)
+	}
+}
+
+func TestManifestsAreKeyedPerSuiteRoot(t *testing.T) {
+	v := &verifyingProxy{}
+	v.setManifest("/dists/stable", map[string]string{"main/binary-amd64/Packages": "stable-hash"})
+	v.setManifest("/dists/nightly", map[string]string{"main/binary-amd64/Packages": "nightly-hash"})
+
+	_, expected, ok := v.lookupManifest("/dists/stable/main/binary-amd64/Packages")
+	if !ok || expected != "stable-hash" {
+		t.Fatalf("stable lookup: got %q, %v", expected, ok)
+	}
+
+	_, expected, ok = v.lookupManifest("/dists/nightly/main/binary-amd64/Packages")
+	if !ok || expected != "nightly-hash" {
+		t.Fatalf("nightly lookup: got %q, %v", expected, ok)
+	}
+}
+
+func TestSetManifestEvictsOldestRootOverLimit(t *testing.T) {
+	v := &verifyingProxy{}
+	for i := 0; i < maxManifestRoots+1; i++ {
+		v.setManifest(string(rune('a'+i%26))+string(rune(i)), map[string]string{"Packages": "x"})
+	}
+	v.mut.Lock()
+	n := len(v.manifests)
+	v.mut.Unlock()
+	if n != maxManifestRoots {
+		t.Fatalf("expected %d manifests retained, got %d", maxManifestRoots, n)
+	}
+	v.mut.Lock()
+	_, oldestKept := v.manifests[string(rune('a'))+string(rune(0))]
+	v.mut.Unlock()
+	if oldestKept {
+		t.Fatalf("expected the oldest root to be the one evicted")
+	}
+}